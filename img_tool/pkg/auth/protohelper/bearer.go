@@ -0,0 +1,197 @@
+package protohelper
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/docker/docker-credential-helpers/client"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// bearerRefreshSkew is how far ahead of the reported expiry we refresh,
+	// so a request in flight never sees a token expire mid-call.
+	bearerRefreshSkew = 30 * time.Second
+	// bearerRefreshJitter spreads refreshes across a window so many
+	// concurrently-started clients don't all hit the token endpoint at once.
+	bearerRefreshJitter = 10 * time.Second
+	// bearerRefreshRetryBackoff is how long to wait before retrying a failed
+	// refresh. The stale token keeps being served in the meantime; if it has
+	// truly expired the next RPC will surface the auth failure.
+	bearerRefreshRetryBackoff = 5 * time.Second
+)
+
+// refreshLoop keeps fetching a fresh token shortly before expiry and
+// publishing it to c.token. It exits once the token source reports no
+// further expiry (a static token).
+func (c *bearerAuthCredentials) refreshLoop(source oauth2.TokenSource, expiry time.Time) {
+	for {
+		wait := time.Until(expiry) - bearerRefreshSkew + time.Duration(rand.Int63n(int64(bearerRefreshJitter)))
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+
+		tok, err := source.Token()
+		if err != nil {
+			time.Sleep(bearerRefreshRetryBackoff)
+			continue
+		}
+
+		c.mu.Lock()
+		c.token = tok.AccessToken
+		c.mu.Unlock()
+
+		if tok.Expiry.IsZero() {
+			return
+		}
+		expiry = tok.Expiry
+	}
+}
+
+// bearerTokenSource resolves a token source for host, trying in order: a
+// token embedded directly in the URL userinfo, a Docker credential helper,
+// and finally a .netrc entry. AWS SigV4 hosts (*.amazonaws.com) are handled
+// separately by sigV4PerRPCCredentials, since a SigV4 signature is bound to
+// one exact request and can't be cached as a reusable bearer token.
+func bearerTokenSource(host string, userinfo *url.Userinfo) (oauth2.TokenSource, error) {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	if userinfo != nil {
+		if token, ok := userinfo.Password(); ok && token != "" {
+			return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}), nil
+		}
+	}
+
+	if token, err := tokenFromCredentialHelper(hostname); err == nil {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}), nil
+	}
+
+	if token, err := tokenFromNetrc(hostname); err == nil {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}), nil
+	}
+
+	return nil, fmt.Errorf("no bearer token source configured for %s", host)
+}
+
+// tokenFromCredentialHelper resolves a bearer token for host via the Docker
+// credential-helper protocol, shelling out to
+// docker-credential-<IMG_CREDENTIAL_HELPER>.
+func tokenFromCredentialHelper(host string) (string, error) {
+	name := os.Getenv("IMG_CREDENTIAL_HELPER")
+	if name == "" {
+		return "", fmt.Errorf("IMG_CREDENTIAL_HELPER not set")
+	}
+
+	creds, err := client.Get(client.NewShellProgramFunc("docker-credential-"+name), host)
+	if err != nil {
+		return "", fmt.Errorf("credential helper %s: %w", name, err)
+	}
+	if creds.Secret == "" {
+		return "", fmt.Errorf("credential helper %s returned no secret for %s", name, host)
+	}
+	return creds.Secret, nil
+}
+
+// tokenFromNetrc reads a password entry for host from a .netrc file,
+// honoring the NETRC environment variable override used by curl and others.
+func tokenFromNetrc(host string) (string, error) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(data))
+	var machine string
+	for i := 0; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "machine", "default":
+			machine = fields[i+1]
+		case "password":
+			if machine == host {
+				return fields[i+1], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no netrc entry for %s", host)
+}
+
+// isAmazonHost reports whether host (optionally with a port) is an AWS
+// endpoint that must be signed with SigV4 rather than resolved as a generic
+// bearer token.
+func isAmazonHost(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	return strings.HasSuffix(hostname, ".amazonaws.com")
+}
+
+// sigV4PerRPCCredentials implements grpc.PerRPCCredentials by signing each
+// RPC individually with AWS SigV4, using the ambient AWS_* environment
+// (credentials, region) on every call. Unlike bearerAuthCredentials it has
+// no notion of a cached, reusable token: a SigV4 signature is bound to the
+// exact request it was computed for, so it cannot be minted once and
+// replayed by a refresh loop. The resulting "AWS4-HMAC-SHA256 ..." value is
+// sent as-is in the authorization header, not wrapped in a "Bearer " prefix.
+type sigV4PerRPCCredentials struct {
+	host string
+}
+
+func newSigV4PerRPCCredentials(host string) *sigV4PerRPCCredentials {
+	return &sigV4PerRPCCredentials{host: host}
+}
+
+func (c *sigV4PerRPCCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving AWS credentials: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://"+c.host+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, sha256EmptyHex, "grpc", cfg.Region, time.Now()); err != nil {
+		return nil, fmt.Errorf("signing request for %s: %w", c.host, err)
+	}
+
+	return map[string]string{
+		"authorization": req.Header.Get("Authorization"),
+	}, nil
+}
+
+func (c *sigV4PerRPCCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// sha256EmptyHex is the hex sha256 digest of an empty payload, required by
+// SigV4 for requests that carry no body.
+const sha256EmptyHex = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
@@ -0,0 +1,103 @@
+package protohelper
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBearerTokenSourceStaticToken(t *testing.T) {
+	userinfo := url.UserPassword("ignored", "s3cr3t-token")
+
+	source, err := bearerTokenSource("host.example.com:9092", userinfo)
+	if err != nil {
+		t.Fatalf("bearerTokenSource returned error: %v", err)
+	}
+
+	tok, err := source.Token()
+	if err != nil {
+		t.Fatalf("Token returned error: %v", err)
+	}
+
+	if tok.AccessToken != "s3cr3t-token" {
+		t.Errorf("expected access token %q, got %q", "s3cr3t-token", tok.AccessToken)
+	}
+	if !tok.Expiry.IsZero() {
+		t.Errorf("expected a static token to have no expiry, got %v", tok.Expiry)
+	}
+}
+
+func TestTokenFromNetrc(t *testing.T) {
+	dir := t.TempDir()
+	netrcPath := filepath.Join(dir, ".netrc")
+	netrc := "machine host.example.com\nlogin bazel\npassword hunter2\n\nmachine other.example.com\npassword wrong\n"
+	if err := os.WriteFile(netrcPath, []byte(netrc), 0o600); err != nil {
+		t.Fatalf("writing netrc fixture: %v", err)
+	}
+
+	t.Setenv("NETRC", netrcPath)
+
+	token, err := tokenFromNetrc("host.example.com")
+	if err != nil {
+		t.Fatalf("tokenFromNetrc returned error: %v", err)
+	}
+	if token != "hunter2" {
+		t.Errorf("expected token %q, got %q", "hunter2", token)
+	}
+
+	if _, err := tokenFromNetrc("missing.example.com"); err == nil {
+		t.Error("expected error for host with no netrc entry")
+	}
+}
+
+func TestIsAmazonHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"bucket.s3.us-east-1.amazonaws.com", true},
+		{"bucket.s3.us-east-1.amazonaws.com:443", true},
+		{"host.example.com", false},
+		{"host.example.com:9092", false},
+	}
+
+	for _, tt := range tests {
+		if got := isAmazonHost(tt.host); got != tt.want {
+			t.Errorf("isAmazonHost(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestSigV4PerRPCCredentialsRawHeader(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secretexample")
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	creds := newSigV4PerRPCCredentials("bucket.s3.us-east-1.amazonaws.com")
+
+	metadata, err := creds.GetRequestMetadata(context.Background())
+	if err != nil {
+		t.Fatalf("GetRequestMetadata returned error: %v", err)
+	}
+
+	auth, ok := metadata["authorization"]
+	if !ok {
+		t.Fatal("authorization header not found in metadata")
+	}
+
+	// A SigV4 header must be sent as-is: it is not an OAuth2 bearer token
+	// and must never be wrapped with a "Bearer " prefix.
+	if strings.HasPrefix(auth, "Bearer ") {
+		t.Errorf("SigV4 authorization header must not be Bearer-prefixed, got %q", auth)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		t.Errorf("expected a raw AWS4-HMAC-SHA256 header, got %q", auth)
+	}
+
+	if creds.RequireTransportSecurity() {
+		t.Error("RequireTransportSecurity should return false")
+	}
+}
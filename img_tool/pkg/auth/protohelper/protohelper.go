@@ -17,6 +17,13 @@ import (
 	"github.com/bazel-contrib/rules_img/img_tool/pkg/auth/grpcheaderinterceptor"
 )
 
+// Client dials a gRPC endpoint described by uri, which may be:
+//   - grpc://host or grpcs://host, optionally with Basic auth userinfo
+//   - grpc+token://host, grpcs+bearer://host, or grpc(s)://host?auth=bearer
+//     for a bearer/OAuth2 token. All three resolve the token the same way:
+//     the userinfo password if one is given, otherwise a credential helper,
+//     otherwise a netrc entry. For *.amazonaws.com hosts each RPC is signed
+//     with AWS SigV4 instead, and any token in the URL is not used.
 func Client(uri string, helper credhelper.Helper, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
 	opts = slices.Clone(opts)
 
@@ -25,22 +32,35 @@ func Client(uri string, helper credhelper.Helper, opts ...grpc.DialOption) (*grp
 		return nil, fmt.Errorf("invalid uri for grpc: %s: %w", uri, err)
 	}
 
-	switch parsed.Scheme {
-	case "grpc":
-		// unencrypted grpc
-		warnUnencryptedGRPC(uri)
-		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	case "grpcs":
-		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(nil)))
-	default:
-		return nil, fmt.Errorf("unsupported scheme for grpc: %s", parsed.Scheme)
+	encrypted, err := transportOpts(parsed)
+	if err != nil {
+		return nil, err
 	}
-
-	// If userinfo is present, add Basic auth credentials
-	if parsed.User != nil && parsed.User.String() != "" {
+	opts = append(opts, encrypted.opt)
+
+	wantsBearer := parsed.Scheme == "grpc+token" || parsed.Scheme == "grpcs+bearer" || parsed.Query().Get("auth") == "bearer"
+
+	switch {
+	case wantsBearer && isAmazonHost(parsed.Host):
+		opts = append(opts, grpc.WithPerRPCCredentials(newSigV4PerRPCCredentials(parsed.Host)))
+	case wantsBearer:
+		bearer, err := newBearerAuthCredentials(parsed.Host, parsed.User)
+		if err != nil {
+			return nil, fmt.Errorf("resolving bearer credentials for %s: %w", uri, err)
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(bearer))
+	case parsed.User != nil && parsed.User.String() != "":
+		// If userinfo is present, add Basic auth credentials
 		opts = append(opts, grpc.WithPerRPCCredentials(basicAuthFromUserinfo(parsed.User)))
 	}
 
+	// Warn on any plaintext transport, bearer token or not: a bearer/OAuth2
+	// secret sent in the clear is the case that most needs the warning, not
+	// one to suppress it.
+	if !encrypted.secure {
+		warnUnencryptedGRPC(uri)
+	}
+
 	target := fmt.Sprintf("dns:%s", parsed.Host)
 
 	opts = append(opts, grpcheaderinterceptor.DialOptions(helper)...)
@@ -48,6 +68,27 @@ func Client(uri string, helper credhelper.Helper, opts ...grpc.DialOption) (*grp
 	return grpc.NewClient(target, opts...)
 }
 
+// transportCredsResult pairs the grpc.DialOption selected for a scheme with
+// whether that transport is encrypted.
+type transportCredsResult struct {
+	opt    grpc.DialOption
+	secure bool
+}
+
+// transportOpts picks transport credentials for the URL's scheme. It
+// accepts the bearer/token scheme aliases in addition to plain grpc/grpcs
+// so the caller doesn't need to special-case them again.
+func transportOpts(parsed *url.URL) (transportCredsResult, error) {
+	switch parsed.Scheme {
+	case "grpc", "grpc+token":
+		return transportCredsResult{opt: grpc.WithTransportCredentials(insecure.NewCredentials())}, nil
+	case "grpcs", "grpcs+bearer":
+		return transportCredsResult{opt: grpc.WithTransportCredentials(credentials.NewTLS(nil)), secure: true}, nil
+	default:
+		return transportCredsResult{}, fmt.Errorf("unsupported scheme for grpc: %s", parsed.Scheme)
+	}
+}
+
 // basicAuthCredentials implements grpc.PerRPCCredentials for Basic auth.
 type basicAuthCredentials struct {
 	username string
@@ -74,6 +115,45 @@ func (c *basicAuthCredentials) RequireTransportSecurity() bool {
 	return false
 }
 
+// bearerAuthCredentials implements grpc.PerRPCCredentials for bearer/OAuth2
+// tokens. The current token is refreshed in the background ahead of expiry
+// so that RPCs never block on a refresh.
+type bearerAuthCredentials struct {
+	mu    sync.RWMutex
+	token string
+}
+
+func newBearerAuthCredentials(host string, userinfo *url.Userinfo) (*bearerAuthCredentials, error) {
+	source, err := bearerTokenSource(host, userinfo)
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := source.Token()
+	if err != nil {
+		return nil, fmt.Errorf("fetching initial bearer token for %s: %w", host, err)
+	}
+
+	creds := &bearerAuthCredentials{token: tok.AccessToken}
+	if !tok.Expiry.IsZero() {
+		go creds.refreshLoop(source, tok.Expiry)
+	}
+	return creds, nil
+}
+
+func (c *bearerAuthCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	c.mu.RLock()
+	token := c.token
+	c.mu.RUnlock()
+	return map[string]string{
+		"authorization": "Bearer " + token,
+	}, nil
+}
+
+func (c *bearerAuthCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
 func warnUnencryptedGRPC(uri string) {
 	warnMutex.Lock()
 	defer warnMutex.Unlock()
@@ -2,22 +2,54 @@ package blobstore
 
 import (
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Supported digest algorithms. SHA256 remains the default for backwards
+// compatibility with existing blob directories.
+const (
+	SHA256 = digest.Algorithm("sha256")
+	SHA512 = digest.Algorithm("sha512")
 )
 
+// hashFactories maps each supported algorithm to its hash.Hash
+// constructor. Register additional algorithms here (e.g. BLAKE3 via
+// lukechampine.com/blake3) to make them usable as a Store's
+// DefaultAlgorithm or as the algorithm of an incoming digest.
+var hashFactories = map[digest.Algorithm]func() hash.Hash{
+	SHA256: sha256.New,
+	SHA512: sha512.New,
+}
+
 // Store manages blob storage on disk with content-addressable naming
 type Store struct {
 	// blobDir is the root directory for blob storage (e.g., "outputDir/blobs")
 	blobDir string
+
+	// DefaultAlgorithm is the digest algorithm used to compute the digest
+	// of content the store hashes itself (WriteSmall, WriteLargeAuto). It
+	// defaults to SHA256; set it to SHA512 in FIPS-only environments.
+	DefaultAlgorithm digest.Algorithm
+
+	// Recipients, when non-empty, are the ocicrypt recipients layers must be
+	// encrypted for. WriteLarge and WriteLargeAuto refuse a plaintext write
+	// while it's set; only WriteLargeEncrypted's own ciphertext writes are
+	// exempt, since they've already gone through encryption.
+	Recipients EncryptionRecipients
 }
 
 // New creates a new blob store with the given root directory
-// The directory structure will be: blobDir/sha256/{hash}
+// The directory structure will be: blobDir/{algorithm}/{hash}
 func New(blobDir string) *Store {
 	return &Store{
 		blobDir: blobDir,
@@ -26,31 +58,92 @@ func New(blobDir string) *Store {
 
 // Init ensures the blob directory structure exists
 func (s *Store) Init() error {
-	return os.MkdirAll(filepath.Join(s.blobDir, "sha256"), 0o755)
+	if err := os.MkdirAll(filepath.Join(s.blobDir, string(SHA256)), 0o755); err != nil {
+		return err
+	}
+	if algo := s.defaultAlgorithm(); algo != SHA256 {
+		if err := os.MkdirAll(filepath.Join(s.blobDir, string(algo)), 0o755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultAlgorithm returns the configured DefaultAlgorithm, or SHA256 if
+// none was set.
+func (s *Store) defaultAlgorithm() digest.Algorithm {
+	if s.DefaultAlgorithm == "" {
+		return SHA256
+	}
+	return s.DefaultAlgorithm
+}
+
+// parseDigest validates that d is a fully-qualified digest using one of the
+// store's supported algorithms.
+func parseDigest(d string) (digest.Digest, error) {
+	parsed, err := digest.Parse(d)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest %s: %w", d, err)
+	}
+	if _, ok := hashFactories[parsed.Algorithm()]; !ok {
+		return "", fmt.Errorf("unsupported digest algorithm %s", parsed.Algorithm())
+	}
+	return parsed, nil
+}
+
+// formatDigest renders a fully-qualified digest string from an algorithm
+// and raw hash sum.
+func formatDigest(algo digest.Algorithm, sum []byte) string {
+	return string(algo) + ":" + hex.EncodeToString(sum)
 }
 
-// Exists checks if a blob with the given digest exists in the store
-func (s *Store) Exists(digest string) bool {
-	path := s.blobPath(digest)
-	_, err := os.Stat(path)
+// Exists checks if a blob with the given digest exists in the store. If
+// digest has no "algo:" prefix, every known algorithm's subdirectory is
+// probed for a matching hex name.
+func (s *Store) Exists(d string) bool {
+	if !strings.Contains(d, ":") {
+		for algo := range hashFactories {
+			if _, err := os.Stat(filepath.Join(s.blobDir, string(algo), d)); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	path, err := s.blobPath(d)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
 	return err == nil
 }
 
-// WriteSmall writes a small blob to the store if it doesn't already exist
+// WriteSmall writes a small blob to the store if it doesn't already exist,
+// hashing it with the store's DefaultAlgorithm.
 // Returns the digest of the written blob
 func (s *Store) WriteSmall(data []byte) (string, error) {
-	// Calculate digest
-	hasher := sha256.New()
+	algo := s.defaultAlgorithm()
+	hasher := hashFactories[algo]()
 	hasher.Write(data)
-	digest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+	digest := formatDigest(algo, hasher.Sum(nil))
+
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	// Hold the per-digest lock across the exists-check and write so two
+	// parallel Bazel actions writing the same digest can't race.
+	unlock, err := lockPath(path + ".lock")
+	if err != nil {
+		return "", fmt.Errorf("locking blob %s: %w", digest, err)
+	}
+	defer unlock()
 
-	// Check if already exists
 	if s.Exists(digest) {
 		return digest, nil
 	}
 
-	// Write to disk
-	path := s.blobPath(digest)
 	if err := os.WriteFile(path, data, 0o644); err != nil {
 		return "", fmt.Errorf("writing blob %s: %w", digest, err)
 	}
@@ -60,25 +153,34 @@ func (s *Store) WriteSmall(data []byte) (string, error) {
 
 // WriteSmallWithDigest writes a small blob with a known digest if it doesn't exist
 // It validates that the data matches the expected digest
-func (s *Store) WriteSmallWithDigest(digest string, data []byte) error {
-	// Check if already exists
-	if s.Exists(digest) {
+func (s *Store) WriteSmallWithDigest(expectedDigest string, data []byte) error {
+	parsed, err := parseDigest(expectedDigest)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.blobDir, string(parsed.Algorithm()), parsed.Hex())
+
+	unlock, err := lockPath(path + ".lock")
+	if err != nil {
+		return fmt.Errorf("locking blob %s: %w", expectedDigest, err)
+	}
+	defer unlock()
+
+	if s.Exists(expectedDigest) {
 		return nil
 	}
 
 	// Validate digest
-	hasher := sha256.New()
+	hasher := hashFactories[parsed.Algorithm()]()
 	hasher.Write(data)
-	actualDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
-
-	if actualDigest != digest {
-		return fmt.Errorf("digest mismatch: expected %s, got %s", digest, actualDigest)
+	actualDigest := formatDigest(parsed.Algorithm(), hasher.Sum(nil))
+	if actualDigest != expectedDigest {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", expectedDigest, actualDigest)
 	}
 
 	// Write to disk
-	path := s.blobPath(digest)
 	if err := os.WriteFile(path, data, 0o644); err != nil {
-		return fmt.Errorf("writing blob %s: %w", digest, err)
+		return fmt.Errorf("writing blob %s: %w", expectedDigest, err)
 	}
 
 	return nil
@@ -86,19 +188,38 @@ func (s *Store) WriteSmallWithDigest(digest string, data []byte) error {
 
 // WriteLarge consumes an io.Reader and writes a large blob to the store if it doesn't exist
 // The digest must be provided as we don't want to buffer the entire content in memory
-func (s *Store) WriteLarge(digest string, r io.Reader) error {
+func (s *Store) WriteLarge(expectedDigest string, r io.Reader) error {
+	if err := RequireEncryption(s.Recipients); err != nil {
+		_, _ = io.Copy(io.Discard, r)
+		return err
+	}
+
+	parsed, err := parseDigest(expectedDigest)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.blobDir, string(parsed.Algorithm()), parsed.Hex())
+
+	// Hold the per-digest lock across the exists-check, write and rename so
+	// two parallel Bazel actions writing the same digest can't race on the
+	// temp-file rename.
+	unlock, err := lockPath(path + ".lock")
+	if err != nil {
+		return fmt.Errorf("locking blob %s: %w", expectedDigest, err)
+	}
+	defer unlock()
+
 	// Check if already exists
-	if s.Exists(digest) {
+	if s.Exists(expectedDigest) {
 		// Still need to consume the reader to avoid broken pipes
 		_, _ = io.Copy(io.Discard, r)
 		return nil
 	}
 
 	// Write to a temporary file first
-	path := s.blobPath(digest)
 	tempFile, err := os.CreateTemp(filepath.Dir(path), "blobstore_tmp")
 	if err != nil {
-		return fmt.Errorf("creating temp file for blob %s: %w", digest, err)
+		return fmt.Errorf("creating temp file for blob %s: %w", expectedDigest, err)
 	}
 	tempPath := tempFile.Name()
 
@@ -107,59 +228,127 @@ func (s *Store) WriteLarge(digest string, r io.Reader) error {
 		_ = os.Remove(tempPath) // Clean up temp file if it still exists
 	}()
 
-	// Calculate digest while writing
-	hasher := sha256.New()
+	hasher := hashFactories[parsed.Algorithm()]()
 	w := io.MultiWriter(tempFile, hasher)
 
 	// Copy data from the reader to the writer
 	if _, err := io.Copy(w, r); err != nil {
-		return fmt.Errorf("writing blob %s: %w", digest, err)
+		return fmt.Errorf("writing blob %s: %w", expectedDigest, err)
 	}
 
 	if err := tempFile.Close(); err != nil {
-		return fmt.Errorf("closing temp file for blob %s: %w", digest, err)
+		return fmt.Errorf("closing temp file for blob %s: %w", expectedDigest, err)
 	}
 
 	// Validate digest
-	actualDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
-	if actualDigest != digest {
-		return fmt.Errorf("digest mismatch for blob: expected %s, got %s", digest, actualDigest)
+	actualDigest := formatDigest(parsed.Algorithm(), hasher.Sum(nil))
+	if actualDigest != expectedDigest {
+		return fmt.Errorf("digest mismatch for blob: expected %s, got %s", expectedDigest, actualDigest)
 	}
 
 	// Atomically rename to final location
 	// if the OS supports it (Windows doesn't really).
 	if err := os.Rename(tempPath, path); err != nil {
 		// if renaming fails, check if the destination is already correct.
-		if s.Exists(digest) {
+		if s.Exists(expectedDigest) {
 			return nil
 		}
-		return fmt.Errorf("renaming blob %s to final location: %w", digest, err)
+		return fmt.Errorf("renaming blob %s to final location: %w", expectedDigest, err)
 	}
 
 	return nil
 }
 
+// WriteLargeAuto consumes an io.Reader and stores it in the CAS, computing
+// its digest (using the store's DefaultAlgorithm) as it streams to disk.
+// Unlike WriteLarge, the digest does not need to be known up front, which
+// suits content whose size and hash aren't known until it has been fully
+// generated (e.g. an eStargz-rebuilt layer). Callers that already know the
+// digest should prefer WriteLarge.
+func (s *Store) WriteLargeAuto(r io.Reader) (string, error) {
+	if err := RequireEncryption(s.Recipients); err != nil {
+		_, _ = io.Copy(io.Discard, r)
+		return "", err
+	}
+	return s.writeLargeAuto(r)
+}
+
+// writeLargeAuto is WriteLargeAuto's implementation, without the Recipients
+// check, so WriteLargeEncrypted can store its own already-encrypted
+// ciphertext through it.
+func (s *Store) writeLargeAuto(r io.Reader) (string, error) {
+	algo := s.defaultAlgorithm()
+
+	tempFile, err := os.CreateTemp(filepath.Join(s.blobDir, string(algo)), "blobstore_tmp")
+	if err != nil {
+		return "", fmt.Errorf("creating temp file for blob: %w", err)
+	}
+	tempPath := tempFile.Name()
+
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempPath) // Clean up temp file if it still exists
+	}()
+
+	hasher := hashFactories[algo]()
+	w := io.MultiWriter(tempFile, hasher)
+
+	if _, err := io.Copy(w, r); err != nil {
+		return "", fmt.Errorf("writing blob: %w", err)
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return "", fmt.Errorf("closing temp file for blob: %w", err)
+	}
+
+	digest := formatDigest(algo, hasher.Sum(nil))
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return "", err
+	}
+
+	unlock, err := lockPath(path + ".lock")
+	if err != nil {
+		return "", fmt.Errorf("locking blob %s: %w", digest, err)
+	}
+	defer unlock()
+
+	if err := os.Rename(tempPath, path); err != nil {
+		// if renaming fails, check if the destination is already correct.
+		if s.Exists(digest) {
+			return digest, nil
+		}
+		return "", fmt.Errorf("renaming blob %s to final location: %w", digest, err)
+	}
+
+	return digest, nil
+}
+
 // ReadSmall reads a small blob from the store as a byte slice
 // Returns an error if the blob doesn't exist
-func (s *Store) ReadSmall(digest string) ([]byte, error) {
-	path := s.blobPath(digest)
+func (s *Store) ReadSmall(expectedDigest string) ([]byte, error) {
+	parsed, err := parseDigest(expectedDigest)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(s.blobDir, string(parsed.Algorithm()), parsed.Hex())
+
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("blob %s not found", digest)
+			return nil, fmt.Errorf("blob %s not found", expectedDigest)
 		}
-		return nil, fmt.Errorf("reading blob %s: %w", digest, err)
+		return nil, fmt.Errorf("reading blob %s: %w", expectedDigest, err)
 	}
 
 	// Validate digest
-	hasher := sha256.New()
+	hasher := hashFactories[parsed.Algorithm()]()
 	hasher.Write(data)
-	actualDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
-
-	if actualDigest != digest {
+	actualDigest := formatDigest(parsed.Algorithm(), hasher.Sum(nil))
+	if actualDigest != expectedDigest {
 		// Remove corrupted blob
 		os.Remove(path)
-		return nil, fmt.Errorf("digest mismatch for blob %s: expected %s, got %s", path, digest, actualDigest)
+		return nil, fmt.Errorf("digest mismatch for blob %s: expected %s, got %s", path, expectedDigest, actualDigest)
 	}
 
 	return data, nil
@@ -167,36 +356,111 @@ func (s *Store) ReadSmall(digest string) ([]byte, error) {
 
 // Open opens a blob for reading, returning an io.ReadCloser
 // The caller is responsible for closing the reader
-func (s *Store) Open(digest string) (io.ReadCloser, error) {
-	path := s.blobPath(digest)
+func (s *Store) Open(expectedDigest string) (io.ReadCloser, error) {
+	parsed, err := parseDigest(expectedDigest)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(s.blobDir, string(parsed.Algorithm()), parsed.Hex())
+
 	file, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("blob %s not found", digest)
+			return nil, fmt.Errorf("blob %s not found", expectedDigest)
 		}
-		return nil, fmt.Errorf("opening blob %s: %w", digest, err)
+		return nil, fmt.Errorf("opening blob %s: %w", expectedDigest, err)
+	}
+
+	release, err := s.Acquire(expectedDigest)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("pinning blob %s: %w", expectedDigest, err)
 	}
 
-	// We return a validatingReader that will check the digest on close
+	// We return a validatingReader that will check the digest once fully read and
+	// hold the blob's refcount pinned for as long as it's being read, so a
+	// concurrent `img gc` can't evict it mid-read.
 	return &validatingReader{
 		file:           file,
 		path:           path,
-		expectedDigest: digest,
-		hasher:         sha256.New(),
+		expectedDigest: expectedDigest,
+		algorithm:      parsed.Algorithm(),
+		hasher:         hashFactories[parsed.Algorithm()](),
+		release:        release,
+	}, nil
+}
+
+// Acquire increments the reference count for digest, returning a release
+// function that must be called exactly once when the caller is done
+// holding it pinned. It lets callers that need a blob to stay put across
+// multiple operations (the pusher, the eStargz converter) coordinate with
+// a future `img gc --older-than=...` command so it doesn't evict a blob
+// that's still in use.
+func (s *Store) Acquire(expectedDigest string) (func() error, error) {
+	path, err := s.blobPath(expectedDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.changeRefCount(path, 1); err != nil {
+		return nil, fmt.Errorf("incrementing refcount for blob %s: %w", expectedDigest, err)
+	}
+
+	released := false
+	return func() error {
+		if released {
+			return nil
+		}
+		released = true
+		return s.changeRefCount(path, -1)
 	}, nil
 }
 
+// changeRefCount adjusts the .refs sidecar for the blob at path by delta,
+// holding the same per-digest lock WriteLarge/WriteSmall use so concurrent
+// updates (including from other processes) don't lose a write.
+func (s *Store) changeRefCount(path string, delta int) error {
+	unlock, err := lockPath(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	refsPath := path + ".refs"
+	count := 0
+	if data, err := os.ReadFile(refsPath); err == nil {
+		count, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+
+	count += delta
+	if count <= 0 {
+		if err := os.Remove(refsPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	return os.WriteFile(refsPath, []byte(strconv.Itoa(count)), 0o644)
+}
+
 // Path returns the filesystem path for a given digest
 // This can be useful for operations that need direct file access
-func (s *Store) Path(digest string) string {
-	return s.blobPath(digest)
+func (s *Store) Path(expectedDigest string) string {
+	path, err := s.blobPath(expectedDigest)
+	if err != nil {
+		return ""
+	}
+	return path
 }
 
-// blobPath constructs the filesystem path for a blob with the given digest
-func (s *Store) blobPath(digest string) string {
-	// Remove "sha256:" prefix if present
-	sha256sum := strings.TrimPrefix(digest, "sha256:")
-	return filepath.Join(s.blobDir, "sha256", sha256sum)
+// blobPath constructs the filesystem path for a fully-qualified
+// ("algo:hex") digest.
+func (s *Store) blobPath(d string) (string, error) {
+	parsed, err := parseDigest(d)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.blobDir, string(parsed.Algorithm()), parsed.Hex()), nil
 }
 
 // validatingReader wraps a file and validates its digest when fully read
@@ -204,9 +468,11 @@ type validatingReader struct {
 	file           *os.File
 	path           string
 	expectedDigest string
-	hasher         io.Writer
+	algorithm      digest.Algorithm
+	hasher         hash.Hash
 	tee            io.Reader
 	initialized    bool
+	release        func() error
 }
 
 func (v *validatingReader) Read(p []byte) (int, error) {
@@ -218,7 +484,7 @@ func (v *validatingReader) Read(p []byte) (int, error) {
 	n, err := v.tee.Read(p)
 	if err == io.EOF {
 		// Validate digest when we reach EOF
-		actualDigest := "sha256:" + hex.EncodeToString(v.hasher.(interface{ Sum([]byte) []byte }).Sum(nil))
+		actualDigest := formatDigest(v.algorithm, v.hasher.Sum(nil))
 		if actualDigest != v.expectedDigest {
 			return n, fmt.Errorf("digest mismatch for blob %s: expected %s, got %s", v.path, v.expectedDigest, actualDigest)
 		}
@@ -227,5 +493,9 @@ func (v *validatingReader) Read(p []byte) (int, error) {
 }
 
 func (v *validatingReader) Close() error {
-	return v.file.Close()
+	closeErr := v.file.Close()
+	if releaseErr := v.release(); releaseErr != nil && closeErr == nil {
+		return releaseErr
+	}
+	return closeErr
 }
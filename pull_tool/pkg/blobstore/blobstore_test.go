@@ -0,0 +1,183 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteSmallSHA512RoundTrip(t *testing.T) {
+	s := New(t.TempDir())
+	s.DefaultAlgorithm = SHA512
+	if err := s.Init(); err != nil {
+		t.Fatalf("Init returned error: %v", err)
+	}
+
+	data := []byte("hello sha512")
+	sum := sha512.Sum512(data)
+	wantDigest := "sha512:" + hex.EncodeToString(sum[:])
+
+	digest, err := s.WriteSmall(data)
+	if err != nil {
+		t.Fatalf("WriteSmall returned error: %v", err)
+	}
+	if digest != wantDigest {
+		t.Fatalf("expected digest %q, got %q", wantDigest, digest)
+	}
+
+	if _, err := os.Stat(filepath.Join(s.blobDir, "sha512", hex.EncodeToString(sum[:]))); err != nil {
+		t.Fatalf("blob not stored under blobDir/sha512/{hex}: %v", err)
+	}
+
+	read, err := s.ReadSmall(digest)
+	if err != nil {
+		t.Fatalf("ReadSmall returned error: %v", err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("expected %q, got %q", data, read)
+	}
+
+	if !s.Exists(hex.EncodeToString(sum[:])) {
+		t.Error("Exists did not find sha512 blob by bare hex, expected it to probe every algorithm directory")
+	}
+
+	rc, err := s.Open(digest)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	defer rc.Close()
+	opened, err := os.ReadFile(filepath.Join(s.blobDir, "sha512", hex.EncodeToString(sum[:])))
+	if err != nil {
+		t.Fatalf("reading blob directly: %v", err)
+	}
+	if !bytes.Equal(opened, data) {
+		t.Errorf("expected %q, got %q", data, opened)
+	}
+}
+
+func TestWriteLargeConcurrentSameDigest(t *testing.T) {
+	s := New(t.TempDir())
+	if err := s.Init(); err != nil {
+		t.Fatalf("Init returned error: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	sum := sha256DigestOf(data)
+
+	const writers = 16
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.WriteLarge(sum, bytes.NewReader(data))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("writer %d: WriteLarge returned error: %v", i, err)
+		}
+	}
+
+	got, err := s.ReadSmall(sum)
+	if err != nil {
+		t.Fatalf("ReadSmall returned error: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("stored blob content does not match the written data")
+	}
+
+	// The lock around WriteLarge's exists-check/write/rename must leave
+	// exactly the final blob behind: no stray temp files from writers that
+	// raced on the same digest.
+	entries, err := os.ReadDir(filepath.Join(s.blobDir, string(SHA256)))
+	if err != nil {
+		t.Fatalf("reading blob dir: %v", err)
+	}
+	for _, e := range entries {
+		if e.Name() == sumHex(sum) || strings.HasSuffix(e.Name(), ".lock") {
+			continue
+		}
+		t.Errorf("unexpected leftover file in blob dir: %s", e.Name())
+	}
+}
+
+func TestAcquireReleaseRefCount(t *testing.T) {
+	s := New(t.TempDir())
+	if err := s.Init(); err != nil {
+		t.Fatalf("Init returned error: %v", err)
+	}
+
+	data := []byte("pin me")
+	digest, err := s.WriteSmall(data)
+	if err != nil {
+		t.Fatalf("WriteSmall returned error: %v", err)
+	}
+
+	releaseA, err := s.Acquire(digest)
+	if err != nil {
+		t.Fatalf("Acquire returned error: %v", err)
+	}
+	releaseB, err := s.Acquire(digest)
+	if err != nil {
+		t.Fatalf("Acquire returned error: %v", err)
+	}
+
+	refsPath := s.Path(digest) + ".refs"
+	assertRefCount := func(want string) {
+		t.Helper()
+		got, err := os.ReadFile(refsPath)
+		if want == "" {
+			if err == nil {
+				t.Errorf("expected .refs sidecar to be gone, found %q", got)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("reading .refs sidecar: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("expected refcount %q, got %q", want, got)
+		}
+	}
+
+	assertRefCount("2")
+
+	if err := releaseA(); err != nil {
+		t.Fatalf("release returned error: %v", err)
+	}
+	assertRefCount("1")
+
+	// A second call must be a no-op, not double-decrement.
+	if err := releaseA(); err != nil {
+		t.Fatalf("second release returned error: %v", err)
+	}
+	assertRefCount("1")
+
+	if err := releaseB(); err != nil {
+		t.Fatalf("release returned error: %v", err)
+	}
+	assertRefCount("")
+}
+
+func sha256DigestOf(data []byte) string {
+	hasher := hashFactories[SHA256]()
+	hasher.Write(data)
+	return formatDigest(SHA256, hasher.Sum(nil))
+}
+
+func sumHex(d string) string {
+	parsed, err := parseDigest(d)
+	if err != nil {
+		return ""
+	}
+	return parsed.Hex()
+}
@@ -0,0 +1,39 @@
+package blobstore
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/bazel-contrib/rules_img/pull_tool/pkg/delta"
+)
+
+// ApplyDelta reconstructs the layer identified by targetDigest from the base
+// layer identified by baseDigest plus a delta.MediaType op stream, verifies
+// the reconstructed content matches targetDigest, and stores it in the CAS.
+func (s *Store) ApplyDelta(baseDigest string, deltaStream io.Reader, targetDigest string) error {
+	baseReader, err := s.Open(baseDigest)
+	if err != nil {
+		return fmt.Errorf("opening base layer %s: %w", baseDigest, err)
+	}
+	defer baseReader.Close()
+
+	base, err := io.ReadAll(baseReader)
+	if err != nil {
+		return fmt.Errorf("reading base layer %s: %w", baseDigest, err)
+	}
+
+	// Stream the reconstructed layer straight into WriteLarge's hashing
+	// writer instead of buffering it in full first: layers can be hundreds
+	// of MB to multiple GB, and WriteLarge already exists to avoid holding
+	// that much content in memory at once.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(delta.Apply(base, deltaStream, pw))
+	}()
+
+	if err := s.WriteLarge(targetDigest, pr); err != nil {
+		return fmt.Errorf("storing reconstructed layer %s: %w", targetDigest, err)
+	}
+
+	return nil
+}
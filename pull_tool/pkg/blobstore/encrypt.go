@@ -0,0 +1,98 @@
+package blobstore
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/helpers"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// EncryptedLayerSuffix is appended to a plain layer media type once it has
+// been wrapped with ocicrypt, e.g.
+// application/vnd.oci.image.layer.v1.tar+gzip+encrypted.
+const EncryptedLayerSuffix = "+encrypted"
+
+// EncryptionRecipients are ocicrypt recipient strings, in the same form
+// accepted on the ocicrypt/skopeo command line: "jwe:PUBKEY" for a JWE
+// public key, "pkcs7:CERT" for a PKCS7 certificate, or "pgp:FINGERPRINT"
+// for a PGP recipient.
+type EncryptionRecipients []string
+
+// WriteLargeEncrypted encrypts r for the given recipients and stores the
+// resulting ciphertext in the CAS, keyed by the ciphertext's own digest
+// (rather than the plaintext digest) since that's what ends up pushed to
+// the registry. It returns the ciphertext digest and the
+// org.opencontainers.image.enc.keys.* annotations the manifest writer must
+// attach to the layer descriptor alongside EncryptedLayerSuffix.
+func (s *Store) WriteLargeEncrypted(r io.Reader, mediaType string, recipients EncryptionRecipients) (digest string, annotations map[string]string, err error) {
+	if len(recipients) == 0 {
+		return "", nil, fmt.Errorf("encrypting layer: no recipients configured")
+	}
+
+	cc, err := helpers.CreateCryptoConfig(recipients, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("parsing encryption recipients: %w", err)
+	}
+
+	desc := ocispec.Descriptor{MediaType: mediaType}
+	encrypted, finalize, err := ocicrypt.EncryptLayer(cc.EncryptConfig, r, desc)
+	if err != nil {
+		return "", nil, fmt.Errorf("encrypting layer: %w", err)
+	}
+
+	// Store through writeLargeAuto, not WriteLargeAuto: encrypted is already
+	// ciphertext, so it must bypass the Recipients plaintext check.
+	digest, err = s.writeLargeAuto(encrypted)
+	if err != nil {
+		return "", nil, fmt.Errorf("storing encrypted layer: %w", err)
+	}
+
+	annotations, err = finalize()
+	if err != nil {
+		return "", nil, fmt.Errorf("finalizing layer encryption: %w", err)
+	}
+
+	return digest, annotations, nil
+}
+
+// DecryptLarge decrypts an encrypted layer blob identified by digest using
+// the recipient's decrypt config and writes the plaintext to w. annotations
+// must be the org.opencontainers.image.enc.keys.*/pubopts annotations
+// WriteLargeEncrypted's finalize() produced for this layer; DecryptLayer
+// reads the wrapped per-layer key from them. It exists to exercise the
+// encryption pipeline from the pull side during testing; production pulls
+// decrypt the layer as part of mounting it.
+func (s *Store) DecryptLarge(digest string, dc *config.DecryptConfig, annotations map[string]string, w io.Writer) error {
+	rc, err := s.Open(digest)
+	if err != nil {
+		return fmt.Errorf("opening encrypted blob %s: %w", digest, err)
+	}
+	defer rc.Close()
+
+	desc := ocispec.Descriptor{Annotations: annotations}
+	plain, _, err := ocicrypt.DecryptLayer(dc, rc, desc, false)
+	if err != nil {
+		return fmt.Errorf("decrypting blob %s: %w", digest, err)
+	}
+
+	if _, err := io.Copy(w, plain); err != nil {
+		return fmt.Errorf("writing decrypted blob %s: %w", digest, err)
+	}
+
+	return nil
+}
+
+// RequireEncryption reports an error if recipients are configured. Store's
+// WriteLarge and WriteLargeAuto call this on every plaintext write via
+// Store.Recipients, so an oci_image target with encryption recipients set
+// can't fall back to an unencrypted layer write; it's also exported for any
+// other pipeline that needs the same refusal ahead of its own write.
+func RequireEncryption(recipients EncryptionRecipients) error {
+	if len(recipients) > 0 {
+		return fmt.Errorf("refusing to upload a plaintext layer: encryption recipients are configured")
+	}
+	return nil
+}
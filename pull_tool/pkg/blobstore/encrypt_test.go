@@ -0,0 +1,100 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/ocicrypt/helpers"
+)
+
+// writeTestRSAKeyPair generates an RSA key pair and writes the public and
+// private halves as PEM files under dir, returning their paths in the form
+// ocicrypt expects ("jwe:" recipients and -key paths).
+func writeTestRSAKeyPair(t *testing.T, dir string) (pubPath, privPath string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("marshaling public key: %v", err)
+	}
+	pubPath = filepath.Join(dir, "recipient.pub.pem")
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o600); err != nil {
+		t.Fatalf("writing public key: %v", err)
+	}
+
+	privDER := x509.MarshalPKCS1PrivateKey(key)
+	privPath = filepath.Join(dir, "recipient.key.pem")
+	if err := os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: privDER}), 0o600); err != nil {
+		t.Fatalf("writing private key: %v", err)
+	}
+
+	return pubPath, privPath
+}
+
+func TestWriteLargeEncryptedDecryptLargeRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	pubPath, privPath := writeTestRSAKeyPair(t, dir)
+
+	s := New(t.TempDir())
+	if err := s.Init(); err != nil {
+		t.Fatalf("Init returned error: %v", err)
+	}
+
+	plaintext := []byte("this is a secret layer")
+	recipients := EncryptionRecipients{"jwe:" + pubPath}
+
+	digest, annotations, err := s.WriteLargeEncrypted(bytes.NewReader(plaintext), "application/vnd.oci.image.layer.v1.tar+gzip", recipients)
+	if err != nil {
+		t.Fatalf("WriteLargeEncrypted returned error: %v", err)
+	}
+	if digest == "" {
+		t.Fatal("expected a non-empty ciphertext digest")
+	}
+	if len(annotations) == 0 {
+		t.Fatal("expected WriteLargeEncrypted to return wrapped-key annotations")
+	}
+
+	stored, err := s.ReadSmall(digest)
+	if err != nil {
+		t.Fatalf("ReadSmall returned error: %v", err)
+	}
+	if bytes.Equal(stored, plaintext) {
+		t.Fatal("stored blob must be ciphertext, not the plaintext layer")
+	}
+
+	dc, err := helpers.CreateDecryptCryptoConfig([]string{privPath}, nil)
+	if err != nil {
+		t.Fatalf("CreateDecryptCryptoConfig returned error: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := s.DecryptLarge(digest, dc.DecryptConfig, annotations, &out); err != nil {
+		t.Fatalf("DecryptLarge returned error: %v", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), plaintext) {
+		t.Errorf("expected decrypted content %q, got %q", plaintext, out.Bytes())
+	}
+}
+
+func TestWriteLargeEncryptedRequiresRecipients(t *testing.T) {
+	s := New(t.TempDir())
+	if err := s.Init(); err != nil {
+		t.Fatalf("Init returned error: %v", err)
+	}
+
+	if _, _, err := s.WriteLargeEncrypted(bytes.NewReader([]byte("x")), "application/vnd.oci.image.layer.v1.tar+gzip", nil); err == nil {
+		t.Error("expected an error when no recipients are configured")
+	}
+}
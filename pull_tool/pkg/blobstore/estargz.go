@@ -0,0 +1,157 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+)
+
+// tocDigestAnnotation is the descriptor annotation stargz-aware snapshotters
+// look for to find the TOC of an eStargz layer without downloading it.
+const tocDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+// EstargzOptions configures how a tar layer is converted to eStargz.
+type EstargzOptions struct {
+	// ChunkSize is the maximum uncompressed size of a chunk within the
+	// resulting blob. Zero selects the estargz package default.
+	ChunkSize int
+	// CompressionLevel is the gzip compression level used for chunk data
+	// (e.g. gzip.BestSpeed .. gzip.BestCompression). Zero selects the
+	// estargz package default.
+	CompressionLevel int
+}
+
+// EstargzLayer describes the result of converting a tar layer to eStargz.
+type EstargzLayer struct {
+	// Digest is the digest of the stored eStargz blob.
+	Digest string
+	// TOCDigest is the digest of the embedded table of contents.
+	TOCDigest string
+	// DiffID is the digest of the uncompressed tar stream that was built.
+	DiffID string
+	// Annotations are the descriptor annotations a manifest writer must
+	// attach to the layer so stargz-aware snapshotters can lazily pull it.
+	Annotations map[string]string
+}
+
+// WriteEstargzLayer rewrites the uncompressed tar held by tarBlob as an
+// eStargz blob (a gzip layer carrying a stargz table of contents), stores
+// the result in the CAS, and returns its descriptor information. The
+// resulting blob still has media type application/vnd.oci.image.layer.v1.tar+gzip;
+// only the TOC annotation marks it as lazily-pullable.
+func (s *Store) WriteEstargzLayer(tarBlob *io.SectionReader, opts EstargzOptions) (EstargzLayer, error) {
+	diffID, err := diffIDOf(tarBlob)
+	if err != nil {
+		return EstargzLayer{}, fmt.Errorf("computing diff id: %w", err)
+	}
+
+	var buildOpts []estargz.Option
+	if opts.ChunkSize > 0 {
+		buildOpts = append(buildOpts, estargz.WithChunkSize(opts.ChunkSize))
+	}
+	if opts.CompressionLevel != 0 {
+		buildOpts = append(buildOpts, estargz.WithCompressionLevel(opts.CompressionLevel))
+	}
+
+	blob, err := estargz.Build(tarBlob, buildOpts...)
+	if err != nil {
+		return EstargzLayer{}, fmt.Errorf("building estargz layer: %w", err)
+	}
+	defer blob.Close()
+
+	digest, err := s.WriteLargeAuto(blob)
+	if err != nil {
+		return EstargzLayer{}, fmt.Errorf("storing estargz layer: %w", err)
+	}
+
+	tocDigest := blob.TOCDigest().String()
+	return EstargzLayer{
+		Digest:    digest,
+		TOCDigest: tocDigest,
+		DiffID:    diffID,
+		Annotations: map[string]string{
+			tocDigestAnnotation: tocDigest,
+		},
+	}, nil
+}
+
+// OpenEstargz opens a stored eStargz blob for random-access chunk reads,
+// e.g. to serve registry range-GETs directly from the CAS. It holds the
+// blob's refcount pinned for as long as the reader is in use, the same way
+// Open's validatingReader does, so a concurrent `img gc` can't evict it out
+// from under an in-flight range-GET. The returned closer must be closed
+// once the reader is no longer needed.
+func (s *Store) OpenEstargz(digest string) (*estargz.Reader, io.Closer, error) {
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	release, err := s.Acquire(digest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pinning blob %s: %w", digest, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		_ = release()
+		if os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("blob %s not found", digest)
+		}
+		return nil, nil, fmt.Errorf("opening blob %s: %w", digest, err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		_ = release()
+		return nil, nil, fmt.Errorf("stat blob %s: %w", digest, err)
+	}
+
+	reader, err := estargz.Open(io.NewSectionReader(f, 0, fi.Size()))
+	if err != nil {
+		_ = f.Close()
+		_ = release()
+		return nil, nil, fmt.Errorf("opening estargz blob %s: %w", digest, err)
+	}
+
+	return reader, &estargzCloser{file: f, release: release}, nil
+}
+
+// estargzCloser closes an eStargz blob's file handle and releases the
+// refcount pin acquired for the duration of the read.
+type estargzCloser struct {
+	file    *os.File
+	release func() error
+}
+
+func (c *estargzCloser) Close() error {
+	closeErr := c.file.Close()
+	if releaseErr := c.release(); releaseErr != nil && closeErr == nil {
+		return releaseErr
+	}
+	return closeErr
+}
+
+// diffIDOf hashes the full uncompressed tar stream and rewinds it so it can
+// still be consumed by estargz.Build afterwards.
+func diffIDOf(tarBlob *io.SectionReader) (string, error) {
+	if _, err := tarBlob.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, tarBlob); err != nil {
+		return "", err
+	}
+
+	if _, err := tarBlob.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
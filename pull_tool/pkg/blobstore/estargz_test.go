@@ -0,0 +1,80 @@
+package blobstore
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// buildTestTar returns a tar stream containing a single regular file with
+// the given name and content.
+func buildTestTar(t *testing.T, name string, content []byte) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0o644,
+		Size: int64(len(content)),
+	}); err != nil {
+		t.Fatalf("writing tar header: %v", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatalf("writing tar content: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar writer: %v", err)
+	}
+	return &buf
+}
+
+func TestWriteEstargzLayerRoundTrip(t *testing.T) {
+	s := New(t.TempDir())
+	if err := s.Init(); err != nil {
+		t.Fatalf("Init returned error: %v", err)
+	}
+
+	content := []byte("hello from an estargz layer")
+	tarBuf := buildTestTar(t, "hello.txt", content)
+	tarReader := bytes.NewReader(tarBuf.Bytes())
+
+	layer, err := s.WriteEstargzLayer(io.NewSectionReader(tarReader, 0, int64(tarReader.Len())), EstargzOptions{})
+	if err != nil {
+		t.Fatalf("WriteEstargzLayer returned error: %v", err)
+	}
+
+	if layer.Digest == "" {
+		t.Fatal("expected a non-empty blob digest")
+	}
+	if layer.TOCDigest == "" {
+		t.Fatal("expected a non-empty TOC digest")
+	}
+	if got := layer.Annotations[tocDigestAnnotation]; got != layer.TOCDigest {
+		t.Errorf("expected %s annotation %q, got %q", tocDigestAnnotation, layer.TOCDigest, got)
+	}
+
+	reader, closer, err := s.OpenEstargz(layer.Digest)
+	if err != nil {
+		t.Fatalf("OpenEstargz returned error: %v", err)
+	}
+	defer closer.Close()
+
+	if reader.TOCDigest().String() != layer.TOCDigest {
+		t.Errorf("expected TOC digest %q, got %q", layer.TOCDigest, reader.TOCDigest().String())
+	}
+
+	fileReader, err := reader.OpenFile("hello.txt")
+	if err != nil {
+		t.Fatalf("OpenFile returned error: %v", err)
+	}
+
+	got := make([]byte, len(content))
+	if _, err := fileReader.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt returned error: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("expected content %q, got %q", content, got)
+	}
+}
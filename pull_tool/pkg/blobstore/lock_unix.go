@@ -0,0 +1,38 @@
+//go:build !windows
+
+package blobstore
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockPath takes an advisory, exclusive flock on path (creating the lock
+// file if necessary) and returns a function that releases it. It closes the
+// TOCTOU window between Exists and os.Rename by serializing writers (and
+// Acquire/release refcount updates) for the same digest.
+func lockPath(path string) (func() error, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return func() error {
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_UN); err != nil {
+			_ = f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
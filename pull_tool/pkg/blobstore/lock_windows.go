@@ -0,0 +1,41 @@
+//go:build windows
+
+package blobstore
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockPath takes an advisory, exclusive lock on path (creating the lock
+// file if necessary) via LockFileEx and returns a function that releases
+// it. It closes the TOCTOU window between Exists and os.Rename by
+// serializing writers (and Acquire/release refcount updates) for the same
+// digest.
+func lockPath(path string) (func() error, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	overlapped := new(windows.Overlapped)
+	if err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, overlapped); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return func() error {
+		unlockOverlapped := new(windows.Overlapped)
+		if err := windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, unlockOverlapped); err != nil {
+			_ = f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
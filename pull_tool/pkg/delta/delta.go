@@ -0,0 +1,235 @@
+// Package delta implements a binary delta encoding for OCI image layers,
+// letting a pusher ship a compact diff against a base layer that's already
+// present on the far end instead of the full layer blob. The scheme mirrors
+// the copy/insert encoding used by git packfiles: a rolling-hash index over
+// the base locates matching runs in the new layer, and everything else is
+// emitted as literal bytes.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MediaType is the descriptor media type for a delta-encoded layer.
+const MediaType = "application/vnd.rules-img.layer.delta.v1"
+
+// BaseDigestAnnotation carries the digest of the base layer a delta was
+// computed against, so the puller knows what to reconstruct it from.
+const BaseDigestAnnotation = "vnd.rules-img.layer.delta.base.digest"
+
+// windowSize is the size of the rolling-hash window used to index the base
+// layer and to search for matches in the target layer.
+const windowSize = 16 * 1024
+
+// maxLiteralRun is the largest number of literal bytes a single insert op
+// can carry; longer runs are split across multiple ops.
+const maxLiteralRun = 127
+
+// copyTag marks an op as copy(offset, length) rather than insert(literal);
+// insert ops instead store their literal length directly in the tag byte,
+// which is always <= maxLiteralRun and so never collides with this bit.
+const copyTag = 0x80
+
+// ShouldUseDelta reports whether a delta of deltaSize bytes is worth
+// uploading in place of the full fullLayerSize-byte layer, per the rule that
+// a delta must be under 70% of the full layer to pay for the extra
+// round-trip and reconstruction cost.
+func ShouldUseDelta(fullLayerSize, deltaSize int64) bool {
+	return deltaSize < (fullLayerSize*70)/100
+}
+
+// Encode computes a delta that reconstructs target from base plus the
+// returned op stream.
+func Encode(base, target []byte) []byte {
+	var out bytes.Buffer
+	writeUvarint(&out, uint64(len(base)))
+	writeUvarint(&out, uint64(len(target)))
+
+	index := buildIndex(base)
+
+	var literal []byte
+	flushLiteral := func() {
+		for len(literal) > 0 {
+			n := len(literal)
+			if n > maxLiteralRun {
+				n = maxLiteralRun
+			}
+			out.WriteByte(byte(n))
+			out.Write(literal[:n])
+			literal = literal[n:]
+		}
+	}
+
+	i := 0
+	if len(target) >= windowSize {
+		a, b := adlerSum(target[:windowSize])
+		for i <= len(target)-windowSize {
+			if offsets, ok := index[checksum(a, b)]; ok {
+				if baseOffset, length, found := bestMatch(base, target, offsets, i); found {
+					flushLiteral()
+					writeCopyOp(&out, baseOffset, length)
+					i += length
+					if i > len(target)-windowSize {
+						break
+					}
+					a, b = adlerSum(target[i : i+windowSize])
+					continue
+				}
+			}
+
+			literal = append(literal, target[i])
+			if i+windowSize < len(target) {
+				a, b = rollAdler(a, b, target[i], target[i+windowSize])
+			}
+			i++
+		}
+	}
+
+	literal = append(literal, target[i:]...)
+	flushLiteral()
+
+	return out.Bytes()
+}
+
+// Apply reconstructs the target layer described by delta using base as the
+// reference, writing the result to w. It returns an error if the delta
+// references a base offset out of range or if its declared base size
+// doesn't match len(base).
+func Apply(base []byte, delta io.Reader, w io.Writer) error {
+	r := bufio.NewReader(delta)
+
+	baseSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("reading delta header: %w", err)
+	}
+	if baseSize != uint64(len(base)) {
+		return fmt.Errorf("delta base size mismatch: delta expects %d bytes, got %d", baseSize, len(base))
+	}
+
+	if _, err := binary.ReadUvarint(r); err != nil { // result_size, not needed to replay the ops
+		return fmt.Errorf("reading delta header: %w", err)
+	}
+
+	for {
+		tag, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading op tag: %w", err)
+		}
+
+		if tag != copyTag {
+			n := int(tag)
+			if _, err := io.CopyN(w, r, int64(n)); err != nil {
+				return fmt.Errorf("reading literal op: %w", err)
+			}
+			continue
+		}
+
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("reading copy offset: %w", err)
+		}
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("reading copy length: %w", err)
+		}
+		if offset+length > uint64(len(base)) {
+			return fmt.Errorf("copy op [%d,%d) out of range for base of size %d", offset, offset+length, len(base))
+		}
+		if _, err := w.Write(base[offset : offset+length]); err != nil {
+			return fmt.Errorf("writing copy op: %w", err)
+		}
+	}
+}
+
+// buildIndex splits base into non-overlapping windowSize windows and
+// records their rolling-hash checksum, so Encode can look up candidate
+// matches for any window-sized run of the target layer.
+func buildIndex(base []byte) map[uint64][]int {
+	index := make(map[uint64][]int)
+	for offset := 0; offset+windowSize <= len(base); offset += windowSize {
+		a, b := adlerSum(base[offset : offset+windowSize])
+		index[checksum(a, b)] = append(index[checksum(a, b)], offset)
+	}
+	return index
+}
+
+// bestMatch extends every candidate offset byte-by-byte and returns the
+// longest common run, if any candidate's checksum match isn't a collision.
+func bestMatch(base, target []byte, offsets []int, targetPos int) (baseOffset, length int, ok bool) {
+	bestLen := 0
+	bestOffset := 0
+	for _, offset := range offsets {
+		l := matchLength(base[offset:], target[targetPos:])
+		if l > bestLen {
+			bestLen = l
+			bestOffset = offset
+		}
+	}
+	if bestLen < windowSize {
+		return 0, 0, false
+	}
+	return bestOffset, bestLen, true
+}
+
+func matchLength(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	i := 0
+	for i < n && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func writeCopyOp(out *bytes.Buffer, offset, length int) {
+	out.WriteByte(copyTag)
+	writeUvarint(out, uint64(offset))
+	writeUvarint(out, uint64(length))
+}
+
+func writeUvarint(out *bytes.Buffer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	out.Write(buf[:n])
+}
+
+// adlerModulus is the modulus used by the rolling checksum below, the same
+// one used by the classic Adler-32 algorithm.
+const adlerModulus = 65521
+
+// adlerSum computes the two rolling-checksum components for window.
+func adlerSum(window []byte) (a, b uint32) {
+	a = 1
+	for _, c := range window {
+		a = (a + uint32(c)) % adlerModulus
+		b = (b + a) % adlerModulus
+	}
+	return a, b
+}
+
+// rollAdler advances the checksum by one byte: oldByte leaves the window as
+// newByte enters it.
+func rollAdler(a, b uint32, oldByte, newByte byte) (uint32, uint32) {
+	na := (int64(a) - int64(oldByte) + int64(newByte)) % adlerModulus
+	if na < 0 {
+		na += adlerModulus
+	}
+	nb := (int64(b) - int64(windowSize)*int64(oldByte) + na - 1) % adlerModulus
+	if nb < 0 {
+		nb += adlerModulus
+	}
+	return uint32(na), uint32(nb)
+}
+
+func checksum(a, b uint32) uint64 {
+	return uint64(a) | uint64(b)<<32
+}
@@ -0,0 +1,75 @@
+package delta
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeApplyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   []byte
+		target []byte
+	}{
+		{
+			name:   "identical layers",
+			base:   bytes.Repeat([]byte("a"), 40*1024),
+			target: bytes.Repeat([]byte("a"), 40*1024),
+		},
+		{
+			name:   "appended content",
+			base:   bytes.Repeat([]byte("a"), 40*1024),
+			target: append(bytes.Repeat([]byte("a"), 40*1024), []byte("new trailing bytes")...),
+		},
+		{
+			name:   "prepended content",
+			base:   bytes.Repeat([]byte("b"), 40*1024),
+			target: append([]byte("new leading bytes"), bytes.Repeat([]byte("b"), 40*1024)...),
+		},
+		{
+			name:   "no common content",
+			base:   bytes.Repeat([]byte("x"), 20*1024),
+			target: bytes.Repeat([]byte("y"), 20*1024),
+		},
+		{
+			name:   "target smaller than window",
+			base:   bytes.Repeat([]byte("z"), 40*1024),
+			target: []byte("short target"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := Encode(tt.base, tt.target)
+
+			var result bytes.Buffer
+			if err := Apply(tt.base, bytes.NewReader(encoded), &result); err != nil {
+				t.Fatalf("Apply returned error: %v", err)
+			}
+
+			if !bytes.Equal(result.Bytes(), tt.target) {
+				t.Errorf("roundtrip mismatch: got %d bytes, want %d bytes", result.Len(), len(tt.target))
+			}
+		})
+	}
+}
+
+func TestEncodeSharedContentProducesSmallDelta(t *testing.T) {
+	base := bytes.Repeat([]byte("shared-layer-content-"), 4*1024)
+	target := append(append([]byte{}, base...), []byte("a small appended change")...)
+
+	encoded := Encode(base, target)
+
+	if !ShouldUseDelta(int64(len(target)), int64(len(encoded))) {
+		t.Errorf("expected delta of %d bytes to beat threshold for a %d byte layer", len(encoded), len(target))
+	}
+}
+
+func TestApplyRejectsBaseSizeMismatch(t *testing.T) {
+	base := bytes.Repeat([]byte("a"), 40*1024)
+	encoded := Encode(base, base)
+
+	if err := Apply(base[:len(base)-1], bytes.NewReader(encoded), &bytes.Buffer{}); err == nil {
+		t.Error("expected error for mismatched base size")
+	}
+}